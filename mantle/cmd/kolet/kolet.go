@@ -15,16 +15,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	systemddbus "github.com/coreos/go-systemd/v22/dbus"
 	systemdjournal "github.com/coreos/go-systemd/v22/journal"
+	"github.com/coreos/go-systemd/v22/sdjournal"
 	"github.com/coreos/pkg/capnslog"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -97,12 +104,238 @@ reboot
 	autopkgtestRebootPrepareScript = `#!/bin/bash
 set -euo pipefail
 exec ~core/kolet reboot-request $1
+`
+
+	autopkgTestRebootTimeoutPath = "/tmp/autopkgtest-reboot-timeout"
+
+	// autopkgtest-reboot-timeout MARK TIMEOUT reboots like autopkgtest-reboot,
+	// but also records a deadline (TIMEOUT seconds from now) in the mark
+	// payload so the harness knows how long to keep polling for the machine
+	// to come back before declaring the test failed.
+	autopkgtestRebootTimeoutScript = `#!/bin/bash
+set -euo pipefail
+~core/kolet reboot-request --reboot-timeout "${2}s" $1
+reboot
 `
 
 	// File used to communicate between the script and the kolet runner internally
 	rebootStamp = "/run/kolet-reboot"
 )
 
+// RebootMethod mirrors the subset of the gNOI System.RebootMethod enum that
+// makes sense for a QEMU/cloud test subject.  It lets a test tell the harness
+// *how* it expects the reboot to be carried out so the harness can assert on
+// that behavior (e.g. that a POWERDOWN doesn't come back on its own).
+type RebootMethod string
+
+const (
+	RebootMethodCold      RebootMethod = "COLD"
+	RebootMethodWarm      RebootMethod = "WARM"
+	RebootMethodPowerdown RebootMethod = "POWERDOWN"
+	RebootMethodHalt      RebootMethod = "HALT"
+	RebootMethodNSF       RebootMethod = "NSF"
+)
+
+// rebootMark is the payload written to rebootStamp and echoed back to the
+// harness inside KoletResult.Reboot.  Older kolet binaries only ever wrote
+// the bare mark string here, so readers must fall back to treating the
+// whole file as the mark when it doesn't parse as JSON.
+type rebootMark struct {
+	Mark        string       `json:"Mark"`
+	Method      RebootMethod `json:"Method,omitempty"`
+	Reason      string       `json:"Reason,omitempty"`
+	ScheduledAt time.Time    `json:"ScheduledAt,omitempty"`
+	// Deadline, if set, is the time until which the harness should keep
+	// polling for the machine to come back before failing the test; it backs the
+	// autopkgtest-reboot-timeout API.
+	Deadline time.Time `json:"Deadline,omitempty"`
+	// Count is this reboot's position in a chain of continuous reboots of
+	// the same test (the autopkgtest AUTOPKGTEST_REBOOT_MARK/KOLA_REBOOT_COUNT
+	// iteration semantics), starting at 1.
+	Count int `json:"Count,omitempty"`
+}
+
+// parseRebootMark decodes the contents of rebootStamp, falling back to
+// treating the whole buffer as a bare mark string for compatibility with
+// kolet binaries predating the structured reboot request payload.
+func parseRebootMark(buf []byte) rebootMark {
+	var m rebootMark
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return rebootMark{Mark: string(buf)}
+	}
+	return m
+}
+
+// Journal streaming
+// ---
+//
+// Historically the only way kola saw test output was after the SSH session
+// ended, or via out-of-band `journalctl` polling.  To get live per-test logs
+// in kola output, runExtUnit follows the journal for the unit under test (and
+// the reboot-wait sentinel) in a background goroutine and interleaves framed
+// JSON journal records with the one-shot KoletResult record on stdout.
+//
+// stdoutMu serializes writes from that goroutine against the main loop's own
+// stdout writes (e.g. the final KoletResult), since both share the same fd.
+
+const journalCursorFile = "/run/kolet-journal-cursor"
+
+var stdoutMu sync.Mutex
+
+// writeFrame marshals v to JSON and writes it as a single line on stdout,
+// serialized against concurrent writers.
+func writeFrame(v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "serializing frame")
+	}
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	fmt.Println(string(buf))
+	return nil
+}
+
+// journalRecord is a single streamed journal entry, framed so the harness
+// can tell it apart from the KoletResult record interleaved on the same
+// stdout stream.
+type journalRecord struct {
+	Type      string            `json:"Type"`
+	Timestamp time.Time         `json:"Timestamp"`
+	Priority  int               `json:"Priority"`
+	Message   string            `json:"Message"`
+	Fields    map[string]string `json:"Fields,omitempty"`
+}
+
+// streamJournal follows the journal for the given sd_journal match
+// expressions (e.g. "_SYSTEMD_UNIT=foo.service"), ORed together, emitting a
+// journalRecord frame for each new entry until done is closed.  The read
+// cursor is persisted to journalCursorFile after every entry so a reboot
+// (which starts a fresh kolet process) resumes streaming without
+// duplicating or losing entries.
+func streamJournal(matches []string, extraFields []string, done <-chan struct{}) {
+	j, err := sdjournal.NewJournal()
+	if err != nil {
+		plog.Errorf("opening journal for streaming: %v", err)
+		return
+	}
+	defer j.Close()
+
+	for i, match := range matches {
+		if i > 0 {
+			if err := j.AddDisjunction(); err != nil {
+				plog.Errorf("adding journal disjunction: %v", err)
+				return
+			}
+		}
+		if err := j.AddMatch(match); err != nil {
+			plog.Errorf("adding journal match %q: %v", match, err)
+			return
+		}
+	}
+
+	if cursor, err := ioutil.ReadFile(journalCursorFile); err == nil {
+		if err := j.SeekCursor(strings.TrimSpace(string(cursor))); err == nil {
+			j.NextSkip(1)
+		} else {
+			j.SeekTail()
+		}
+	} else {
+		j.SeekTail()
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		n, err := j.Next()
+		if err != nil {
+			plog.Errorf("reading journal: %v", err)
+			return
+		}
+		if n == 0 {
+			j.Wait(time.Second)
+			continue
+		}
+
+		entry, err := j.GetEntry()
+		if err != nil {
+			plog.Errorf("reading journal entry: %v", err)
+			continue
+		}
+
+		prio, _ := strconv.Atoi(entry.Fields["PRIORITY"])
+		rec := journalRecord{
+			Type:      "journal",
+			Timestamp: time.Unix(0, int64(entry.RealtimeTimestamp)*int64(time.Microsecond)),
+			Priority:  prio,
+			Message:   entry.Fields["MESSAGE"],
+		}
+		if len(extraFields) > 0 {
+			rec.Fields = make(map[string]string, len(extraFields))
+			for _, f := range extraFields {
+				if v, ok := entry.Fields[f]; ok {
+					rec.Fields[f] = v
+				}
+			}
+		}
+		if err := writeFrame(&rec); err != nil {
+			plog.Errorf("writing journal frame: %v", err)
+		}
+
+		if cursor, err := j.GetCursor(); err == nil {
+			ioutil.WriteFile(journalCursorFile, []byte(cursor), 0644)
+		}
+	}
+}
+
+// newCancelableContext builds a context that is cancelled either by
+// SIGTERM/SIGINT (so the harness can ask kolet to give up cleanly) or, if
+// timeout is non-zero, by a deadline.  It's used for commands like
+// run-test-unit and reboot-request that can otherwise block forever.
+func newCancelableContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		defer signal.Stop(sigch)
+		select {
+		case <-sigch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// newUserConnection opens a D-Bus connection to the given user's systemd
+// --user instance, by pointing the session bus lookup at their
+// XDG_RUNTIME_DIR the way systemd itself would locate it, rather than
+// shelling out to `systemctl --user`.  This lets run-test-unit validate
+// rootless/user-scoped services (Podman quadlets, user timers, ...) even
+// though kolet itself always runs as root.
+func newUserConnection(ctx context.Context, username string) (*systemddbus.Conn, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, errors.Wrapf(err, "looking up user %q", username)
+	}
+	runtimeDir := fmt.Sprintf("/run/user/%s", u.Uid)
+	if err := os.Setenv("XDG_RUNTIME_DIR", runtimeDir); err != nil {
+		return nil, err
+	}
+	if err := os.Setenv("DBUS_SESSION_BUS_ADDRESS", fmt.Sprintf("unix:path=%s/bus", runtimeDir)); err != nil {
+		return nil, err
+	}
+	return systemddbus.NewUserConnectionContext(ctx)
+}
+
 var (
 	plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kolet")
 
@@ -119,16 +352,39 @@ var (
 	}
 
 	cmdRunExtUnit = &cobra.Command{
-		Use:          "run-test-unit [unitname]",
-		Short:        "Monitor execution of a systemd unit",
-		RunE:         runExtUnit,
+		Use:   "run-test-unit [unitname]",
+		Short: "Monitor execution of a systemd unit",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := newCancelableContext(runTestUnitTimeout)
+			defer cancel()
+			return runExtUnit(ctx, args[0])
+		},
 		SilenceUsage: true,
 	}
+	journalFields      []string
+	runTestUnitTimeout time.Duration
+	runTestUnitUser    string
 
 	cmdReboot = &cobra.Command{
-		Use:          "reboot-request MARK",
-		Short:        "Request a reboot",
-		RunE:         runReboot,
+		Use:   "reboot-request MARK",
+		Short: "Request a reboot",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := newCancelableContext(0)
+			defer cancel()
+			return runReboot(ctx, args[0])
+		},
+		SilenceUsage: true,
+	}
+	rebootMethod     string
+	rebootDelay      time.Duration
+	rebootReason     string
+	rebootTimeout    time.Duration
+	rebootMaxReboots int
+
+	cmdRebootCancel = &cobra.Command{
+		Use:          "reboot-cancel",
+		Short:        "Cancel a scheduled but not-yet-executed reboot",
+		RunE:         runRebootCancel,
 		SilenceUsage: true,
 	}
 )
@@ -170,10 +426,64 @@ func registerTestMap(m map[string]*register.Test) {
 	}
 }
 
-// dispatchRunExtUnit returns true if unit completed successfully, false if
+// unitDispatcher evaluates the current state of unitname and returns true
+// once it has reached a terminal success state, false while it's still
+// pending, or an error on terminal failure.  Each systemd unit type has
+// different success semantics, so run-test-unit picks a dispatcher based on
+// the unit's suffix; see unitDispatcherFor.
+type unitDispatcher func(ctx context.Context, sdconn *systemddbus.Conn, unitname string) (bool, error)
+
+var unitDispatchers = map[string]unitDispatcher{
+	".service": dispatchServiceUnit,
+	".mount":   dispatchMountUnit,
+	".socket":  dispatchSocketUnit,
+	".timer":   dispatchTimerUnit,
+	".path":    dispatchPathUnit,
+}
+
+// unitDispatcherFor picks the unitDispatcher matching unitname's suffix,
+// appending ".service" (the historical default) if it has none of the
+// known suffixes.
+func unitDispatcherFor(unitname string) (unitDispatcher, string) {
+	for suffix, d := range unitDispatchers {
+		if strings.HasSuffix(unitname, suffix) {
+			return d, unitname
+		}
+	}
+	return dispatchServiceUnit, unitname + ".service"
+}
+
+// triggeredUnitName returns the name of the .service unit that a socket,
+// timer, or path unit of the given suffix activates, following systemd's
+// naming convention of sharing the same unit basename.
+func triggeredUnitName(unitname, suffix string) string {
+	return strings.TrimSuffix(unitname, suffix) + ".service"
+}
+
+// watchedTriggeredUnit returns the triggered .service unit name that must
+// also be watched for unitname's dispatcher to make progress, or "" if
+// unitname's own state changes are sufficient (services and mounts).  A
+// socket's own ActiveState/SubState stay "active"/"listening" for the
+// whole test, so without also watching the triggered service, run-test-unit
+// would never see another event and would hang forever once the socket is
+// up; timer and path units are similarly evaluated against their target.
+func watchedTriggeredUnit(unitname string) string {
+	switch {
+	case strings.HasSuffix(unitname, ".socket"):
+		return triggeredUnitName(unitname, ".socket")
+	case strings.HasSuffix(unitname, ".timer"):
+		return triggeredUnitName(unitname, ".timer")
+	case strings.HasSuffix(unitname, ".path"):
+		return triggeredUnitName(unitname, ".path")
+	default:
+		return ""
+	}
+}
+
+// dispatchServiceUnit returns true if unit completed successfully, false if
 // it's still running (or unit was terminated by SIGTERM)
-func dispatchRunExtUnit(unitname string, sdconn *systemddbus.Conn) (bool, error) {
-	props, err := sdconn.GetAllProperties(unitname)
+func dispatchServiceUnit(ctx context.Context, sdconn *systemddbus.Conn, unitname string) (bool, error) {
+	props, err := sdconn.GetAllPropertiesContext(ctx, unitname)
 	if err != nil {
 		return false, errors.Wrapf(err, "listing unit properties")
 	}
@@ -188,7 +498,7 @@ func dispatchRunExtUnit(unitname string, sdconn *systemddbus.Conn) (bool, error)
 
 	switch state {
 	case "inactive":
-		sdconn.StartUnit(unitname, "fail", nil)
+		sdconn.StartUnitContext(ctx, unitname, "fail", nil)
 		return false, nil
 	case "activating":
 		return false, nil
@@ -226,24 +536,197 @@ func dispatchRunExtUnit(unitname string, sdconn *systemddbus.Conn) (bool, error)
 	}
 }
 
+// dispatchMountUnit treats a .mount unit as successful once it reaches the
+// "mounted" substate; unlike a service it doesn't exit, it just stays
+// mounted for the duration of the test.
+func dispatchMountUnit(ctx context.Context, sdconn *systemddbus.Conn, unitname string) (bool, error) {
+	props, err := sdconn.GetUnitPropertiesContext(ctx, unitname)
+	if err != nil {
+		return false, errors.Wrapf(err, "listing unit properties")
+	}
+
+	switch props["ActiveState"] {
+	case "inactive":
+		sdconn.StartUnitContext(ctx, unitname, "fail", nil)
+		return false, nil
+	case "active":
+		if props["SubState"] == "mounted" {
+			return true, nil
+		}
+		return false, nil
+	case "failed":
+		return true, fmt.Errorf("Unit %s in substate 'failed'", unitname)
+	default:
+		return false, nil
+	}
+}
+
+// dispatchSocketUnit starts the socket unit and waits for the service it
+// activates to have handled at least one connection and reached an
+// inactive-success state, per the request's success criterion for
+// socket-activated tests.
+func dispatchSocketUnit(ctx context.Context, sdconn *systemddbus.Conn, unitname string) (bool, error) {
+	props, err := sdconn.GetAllPropertiesContext(ctx, unitname)
+	if err != nil {
+		return false, errors.Wrapf(err, "listing unit properties")
+	}
+
+	switch props["ActiveState"] {
+	case "inactive":
+		sdconn.StartUnitContext(ctx, unitname, "fail", nil)
+		return false, nil
+	case "failed":
+		return true, fmt.Errorf("Socket unit %s in substate 'failed'", unitname)
+	}
+
+	nconn, _ := props["NConnections"].(uint32)
+	if nconn == 0 {
+		// No client has connected yet, so the activated service hasn't run.
+		return false, nil
+	}
+	return dispatchServiceUnit(ctx, sdconn, triggeredUnitName(unitname, ".socket"))
+}
+
+// dispatchTimerUnit starts the timer unit and waits for its first
+// OnCalendar/OnUnitActiveSec firing, then evaluates the templated service
+// it triggers the same way a .service unit is evaluated.
+func dispatchTimerUnit(ctx context.Context, sdconn *systemddbus.Conn, unitname string) (bool, error) {
+	props, err := sdconn.GetAllPropertiesContext(ctx, unitname)
+	if err != nil {
+		return false, errors.Wrapf(err, "listing unit properties")
+	}
+
+	switch props["ActiveState"] {
+	case "inactive":
+		sdconn.StartUnitContext(ctx, unitname, "fail", nil)
+		return false, nil
+	case "failed":
+		return true, fmt.Errorf("Timer unit %s in substate 'failed'", unitname)
+	}
+
+	lastTrigger, _ := props["LastTriggerUSec"].(uint64)
+	if lastTrigger == 0 {
+		// Hasn't fired yet.
+		return false, nil
+	}
+	return dispatchServiceUnit(ctx, sdconn, triggeredUnitName(unitname, ".timer"))
+}
+
+// dispatchPathUnit starts the path unit and waits for its first activation
+// (the triggered service having actually run at least once), then
+// evaluates that service the same way a .service unit is evaluated.
+func dispatchPathUnit(ctx context.Context, sdconn *systemddbus.Conn, unitname string) (bool, error) {
+	props, err := sdconn.GetUnitPropertiesContext(ctx, unitname)
+	if err != nil {
+		return false, errors.Wrapf(err, "listing unit properties")
+	}
+
+	switch props["ActiveState"] {
+	case "inactive":
+		sdconn.StartUnitContext(ctx, unitname, "fail", nil)
+		return false, nil
+	case "failed":
+		return true, fmt.Errorf("Path unit %s in substate 'failed'", unitname)
+	}
+
+	svcname := triggeredUnitName(unitname, ".path")
+	svcProps, err := sdconn.GetUnitPropertiesContext(ctx, svcname)
+	if err != nil {
+		return false, errors.Wrapf(err, "listing triggered unit properties")
+	}
+	if inactiveExit, _ := svcProps["InactiveExitTimestamp"].(uint64); inactiveExit == 0 {
+		// The watched path hasn't been triggered yet.
+		return false, nil
+	}
+	return dispatchServiceUnit(ctx, sdconn, svcname)
+}
+
+// waitForUnitInactive polls unitname until it reaches an inactive substate
+// or ctx is done, whichever comes first.  It's used to bound how long
+// cancellation waits for StopUnit to actually take effect.
+func waitForUnitInactive(ctx context.Context, sdconn *systemddbus.Conn, unitname string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		props, err := sdconn.GetUnitPropertiesContext(ctx, unitname)
+		if err != nil {
+			return
+		}
+		switch props["ActiveState"] {
+		case "inactive", "failed":
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// handleCancellation stops the test unit and the reboot-wait sentinel after
+// the run-test-unit context is cancelled (SIGTERM/SIGINT or --timeout),
+// waits (bounded) for them to actually stop, and reports the cancellation
+// to the harness as a timeout rather than a crash.
+func handleCancellation(unitname string) error {
+	// Cancellation already fired on the caller's context, so use a fresh,
+	// short-lived one for the cleanup itself.
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer stopCancel()
+
+	sysConn, err := systemddbus.NewSystemConnectionContext(stopCtx)
+	if err != nil {
+		plog.Errorf("reconnecting to systemd to stop %s: %v", kola.KoletRebootWaitUnit, err)
+		sysConn = nil
+	} else {
+		if _, err := sysConn.StopUnitContext(stopCtx, kola.KoletRebootWaitUnit, "fail", nil); err != nil {
+			plog.Errorf("stopping %s after cancellation: %v", kola.KoletRebootWaitUnit, err)
+		}
+		waitForUnitInactive(stopCtx, sysConn, kola.KoletRebootWaitUnit)
+	}
+
+	testConn := sysConn
+	if runTestUnitUser != "" {
+		testConn, err = newUserConnection(stopCtx, runTestUnitUser)
+		if err != nil {
+			plog.Errorf("reconnecting to user systemd to stop %s: %v", unitname, err)
+			testConn = nil
+		}
+	}
+	if testConn != nil {
+		if _, err := testConn.StopUnitContext(stopCtx, unitname, "fail", nil); err != nil {
+			plog.Errorf("stopping %s after cancellation: %v", unitname, err)
+		}
+		waitForUnitInactive(stopCtx, testConn, unitname)
+	}
+
+	res := kola.KoletResult{Timeout: true}
+	if err := writeFrame(&res); err != nil {
+		plog.Errorf("writing timeout KoletResult: %v", err)
+	}
+	return fmt.Errorf("run-test-unit %s was cancelled (timeout or signal)", unitname)
+}
+
 func initiateReboot() error {
 	contents, err := ioutil.ReadFile(rebootStamp)
 	if err != nil {
 		return err
 	}
+	mark := parseRebootMark(contents)
+	markbuf, err := json.Marshal(&mark)
+	if err != nil {
+		return errors.Wrapf(err, "serializing reboot mark")
+	}
 	res := kola.KoletResult{
-		Reboot: string(contents),
+		Reboot: string(markbuf),
 	}
-	buf, err := json.Marshal(&res)
-	if err != nil {
+	if err := writeFrame(&res); err != nil {
 		return errors.Wrapf(err, "serializing KoletResult")
 	}
-	fmt.Println(string(buf))
-	systemdjournal.Print(systemdjournal.PriInfo, "Acknowledged reboot request with mark: %s", buf)
+	systemdjournal.Print(systemdjournal.PriInfo, "Acknowledged reboot request with mark: %s", markbuf)
 	return nil
 }
 
-func runExtUnit(cmd *cobra.Command, args []string) error {
+func runExtUnit(ctx context.Context, unitname string) error {
 	// Write the autopkgtest wrappers
 	if err := ioutil.WriteFile(autopkgTestRebootPath, []byte(autopkgtestRebootScript), 0755); err != nil {
 		return err
@@ -251,63 +734,168 @@ func runExtUnit(cmd *cobra.Command, args []string) error {
 	if err := ioutil.WriteFile(autopkgTestRebootPreparePath, []byte(autopkgtestRebootPrepareScript), 0755); err != nil {
 		return err
 	}
-
-	unitname := args[0]
-	// Restrict this to services, don't need to support anything else right now
-	if !strings.HasSuffix(unitname, ".service") {
-		unitname = unitname + ".service"
+	if err := ioutil.WriteFile(autopkgTestRebootTimeoutPath, []byte(autopkgtestRebootTimeoutScript), 0755); err != nil {
+		return err
 	}
-	sdconn, err := systemddbus.NewSystemConnection()
+
+	dispatch, unitname := unitDispatcherFor(unitname)
+	triggeredUnit := watchedTriggeredUnit(unitname)
+	unitJournalField := "_SYSTEMD_UNIT"
+
+	sysConn, err := systemddbus.NewSystemConnectionContext(ctx)
 	if err != nil {
 		return errors.Wrapf(err, "systemd connection")
 	}
 
+	// A user instance can't reboot the machine, so the sentinel that the
+	// harness synchronizes on always runs on the system bus (see
+	// runReboot); only the test unit itself moves to the user bus.
+	testConn := sysConn
+	if runTestUnitUser != "" {
+		testConn, err = newUserConnection(ctx, runTestUnitUser)
+		if err != nil {
+			return errors.Wrapf(err, "user systemd connection")
+		}
+		unitJournalField = "_SYSTEMD_USER_UNIT"
+	}
+
 	// Start the unit; it's not started by default because we need to
 	// do some preparatory work above (and some is done in the harness)
-	if _, err := sdconn.StartUnit(unitname, "fail", nil); err != nil {
+	if _, err := testConn.StartUnitContext(ctx, unitname, "fail", nil); err != nil {
 		return errors.Wrapf(err, "starting unit")
 	}
 
-	if err := sdconn.Subscribe(); err != nil {
+	if err := testConn.Subscribe(); err != nil {
 		return err
 	}
-	dispatchRunExtUnit(unitname, sdconn)
-	unitevents, uniterrs := sdconn.SubscribeUnits(time.Second)
+	if testConn != sysConn {
+		if err := sysConn.Subscribe(); err != nil {
+			return err
+		}
+	}
+
+	journalMatches := []string{
+		unitJournalField + "=" + unitname,
+		"_SYSTEMD_UNIT=" + kola.KoletRebootWaitUnit,
+	}
+	if triggeredUnit != "" {
+		// Socket/timer/path units are just triggers; the test's actual
+		// output goes to the service they activate, so that's what
+		// needs to be streamed too.
+		journalMatches = append(journalMatches, unitJournalField+"="+triggeredUnit)
+	}
+	go streamJournal(journalMatches, journalFields, ctx.Done())
+
+	dispatch(ctx, testConn, unitname)
+	testEvents, testErrs := testConn.SubscribeUnits(time.Second)
+
+	// When the test unit lives on the user bus, the reboot-wait sentinel
+	// still needs to be watched on the system bus in parallel; otherwise
+	// sysConn == testConn and these stay nil, which never fire in a
+	// select and testEvents/testErrs alone cover both units as before.
+	var rebootEvents <-chan map[string]*systemddbus.UnitStatus
+	var rebootErrs <-chan error
+	if testConn != sysConn {
+		rebootEvents, rebootErrs = sysConn.SubscribeUnits(time.Second)
+	}
 
 	for {
 		select {
-		case m := <-unitevents:
+		case <-ctx.Done():
+			return handleCancellation(unitname)
+		case m := <-testEvents:
 			for n := range m {
-				if n == unitname {
-					r, err := dispatchRunExtUnit(unitname, sdconn)
+				if n == unitname || (triggeredUnit != "" && n == triggeredUnit) {
+					r, err := dispatch(ctx, testConn, unitname)
 					if err != nil {
 						return err
 					}
 					if r {
 						return nil
 					}
-				} else if n == kola.KoletRebootWaitUnit {
+				} else if testConn == sysConn && n == kola.KoletRebootWaitUnit {
 					return initiateReboot()
 				}
 			}
-		case m := <-uniterrs:
-			return m
+		case m := <-rebootEvents:
+			for n := range m {
+				if n == kola.KoletRebootWaitUnit {
+					return initiateReboot()
+				}
+			}
+		case err := <-testErrs:
+			return err
+		case err := <-rebootErrs:
+			return err
 		}
 	}
 }
 
+// koletRebootCountEnv is set by the harness (as KOLA_REBOOT_COUNT) when it
+// re-execs a test's native function after a reboot, so a test doing
+// continuous reboots can tell which iteration it's on and so reboot-request
+// can refuse to keep going past --max-reboots.
+const koletRebootCountEnv = "KOLA_REBOOT_COUNT"
+
 // This is a backend intending to support at least the same
 // API as defined by Debian autopkgtests:
 // https://salsa.debian.org/ci-team/autopkgtest/raw/master/doc/README.package-tests.rst
-func runReboot(cmd *cobra.Command, args []string) error {
-	mark := args[0]
-	systemdjournal.Print(systemdjournal.PriInfo, "Requesting reboot with mark: %s", mark)
-	err := ioutil.WriteFile(rebootStamp, []byte(mark), 0644)
+//
+// It has also grown a gNOI-style structured request (method + delay +
+// reason) on top of the plain mark, so the harness can enforce the
+// requested reboot method rather than always doing a plain `reboot`.
+func runReboot(ctx context.Context, requestedMark string) error {
+	method := RebootMethod(strings.ToUpper(rebootMethod))
+	switch method {
+	case RebootMethodCold, RebootMethodWarm, RebootMethodPowerdown, RebootMethodHalt, RebootMethodNSF:
+	default:
+		return fmt.Errorf("unknown reboot method %q", rebootMethod)
+	}
+
+	count := 0
+	if v := os.Getenv(koletRebootCountEnv); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			count = n
+		}
+	}
+	if count >= rebootMaxReboots {
+		return fmt.Errorf("refusing reboot: %s is %d, at or past the configured max of %d", koletRebootCountEnv, count, rebootMaxReboots)
+	}
+
+	mark := rebootMark{
+		Mark:   requestedMark,
+		Method: method,
+		Reason: rebootReason,
+		Count:  count + 1,
+	}
+	// Only a genuinely delayed reboot has a meaningful schedule; leaving
+	// this zero for the common --delay 0 case lets reboot-cancel's
+	// IsZero() check correctly treat the reboot as still cancellable
+	// instead of reporting it as already due.
+	if rebootDelay > 0 {
+		mark.ScheduledAt = time.Now().Add(rebootDelay)
+	}
+	if rebootTimeout > 0 {
+		mark.Deadline = time.Now().Add(rebootTimeout)
+	}
+	buf, err := json.Marshal(&mark)
 	if err != nil {
+		return errors.Wrapf(err, "serializing reboot mark")
+	}
+	systemdjournal.Print(systemdjournal.PriInfo, "Requesting %s reboot with mark %q, reason: %s", method, mark.Mark, mark.Reason)
+	if err := ioutil.WriteFile(rebootStamp, buf, 0644); err != nil {
 		return err
 	}
-	// Synchronously wait until the mark is propagated back to the harness
-	err = exec.Command("systemd-run", "-q", "--wait", "--unit", kola.KoletRebootWaitUnit, "--", "sleep", "infinity").Run()
+
+	// Synchronously wait until the mark is propagated back to the harness.
+	// A non-zero delay extends the sentinel's sleep so the harness can
+	// observe the unit is still running until the requested time arrives;
+	// the harness stops it (or it runs to completion) exactly as before.
+	sleepArg := "infinity"
+	if rebootDelay > 0 {
+		sleepArg = strconv.FormatFloat(rebootDelay.Seconds(), 'f', -1, 64)
+	}
+	err = exec.CommandContext(ctx, "systemd-run", "-q", "--wait", "--unit", kola.KoletRebootWaitUnit, "--", "sleep", sleepArg).Run()
 	if err != nil {
 		return errors.Wrapf(err, "starting %s", kola.KoletRebootWaitUnit)
 	}
@@ -315,13 +903,52 @@ func runReboot(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// runRebootCancel aborts a reboot that was requested via runReboot but
+// hasn't fired yet, by stopping the sentinel unit before its sleep
+// elapses and removing the mark file so a stale request can't resurface.
+func runRebootCancel(cmd *cobra.Command, args []string) error {
+	contents, err := ioutil.ReadFile(rebootStamp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no reboot is currently scheduled")
+		}
+		return err
+	}
+	mark := parseRebootMark(contents)
+	if !mark.ScheduledAt.IsZero() && time.Now().After(mark.ScheduledAt) {
+		return fmt.Errorf("reboot with mark %q is already due, too late to cancel", mark.Mark)
+	}
+
+	sdconn, err := systemddbus.NewSystemConnection()
+	if err != nil {
+		return errors.Wrapf(err, "systemd connection")
+	}
+	if _, err := sdconn.StopUnit(kola.KoletRebootWaitUnit, "fail", nil); err != nil {
+		return errors.Wrapf(err, "stopping %s", kola.KoletRebootWaitUnit)
+	}
+	if err := os.Remove(rebootStamp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	systemdjournal.Print(systemdjournal.PriInfo, "Cancelled reboot with mark %q", mark.Mark)
+	return nil
+}
+
 func main() {
 	registerTestMap(register.Tests)
 	registerTestMap(register.UpgradeTests)
 	root.AddCommand(cmdRun)
+	cmdRunExtUnit.Flags().StringSliceVar(&journalFields, "journal-fields", nil, "extra structured journal fields to include in streamed records (e.g. SYSLOG_IDENTIFIER, CODE_FILE)")
+	cmdRunExtUnit.Flags().DurationVar(&runTestUnitTimeout, "timeout", 0, "cancel the test unit and report a timeout if it hasn't completed within this duration")
+	cmdRunExtUnit.Flags().StringVar(&runTestUnitUser, "user", "", "run the test unit under this user's systemd --user instance instead of the system bus")
 	root.AddCommand(cmdRunExtUnit)
 	cmdReboot.Args = cobra.ExactArgs(1)
+	cmdReboot.Flags().StringVar(&rebootMethod, "method", string(RebootMethodCold), "reboot method (COLD, WARM, POWERDOWN, HALT, NSF)")
+	cmdReboot.Flags().DurationVar(&rebootDelay, "delay", 0, "delay before the reboot fires")
+	cmdReboot.Flags().StringVar(&rebootReason, "reason", "", "free-text reason journaled and stored alongside the mark")
+	cmdReboot.Flags().DurationVar(&rebootTimeout, "reboot-timeout", 0, "how long the harness should wait for the machine to come back, backing autopkgtest-reboot-timeout")
+	cmdReboot.Flags().IntVar(&rebootMaxReboots, "max-reboots", 5, "refuse to reboot again once KOLA_REBOOT_COUNT reaches this many, to prevent runaway reboot loops")
 	root.AddCommand(cmdReboot)
+	root.AddCommand(cmdRebootCancel)
 
 	cli.Execute(root)
 }
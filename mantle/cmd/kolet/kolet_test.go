@@ -0,0 +1,155 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRebootMark(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want rebootMark
+	}{
+		{
+			name: "bare mark string, predates structured payload",
+			in:   []byte("some-mark"),
+			want: rebootMark{Mark: "some-mark"},
+		},
+		{
+			name: "structured JSON payload",
+			in:   []byte(`{"Mark":"some-mark","Method":"WARM","Reason":"upgrade"}`),
+			want: rebootMark{Mark: "some-mark", Method: RebootMethodWarm, Reason: "upgrade"},
+		},
+		{
+			name: "empty file falls back to an empty bare mark",
+			in:   []byte(""),
+			want: rebootMark{Mark: ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRebootMark(tt.in)
+			if !got.ScheduledAt.IsZero() || !got.Deadline.IsZero() {
+				t.Fatalf("parseRebootMark(%q) set a time field unexpectedly: %+v", tt.in, got)
+			}
+			got.ScheduledAt = time.Time{}
+			got.Deadline = time.Time{}
+			if got != tt.want {
+				t.Errorf("parseRebootMark(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func funcName(f unitDispatcher) string {
+	return runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+}
+
+func TestUnitDispatcherFor(t *testing.T) {
+	tests := []struct {
+		in           string
+		wantDispatch unitDispatcher
+		wantUnitname string
+	}{
+		{"foo", dispatchServiceUnit, "foo.service"},
+		{"foo.service", dispatchServiceUnit, "foo.service"},
+		{"foo.mount", dispatchMountUnit, "foo.mount"},
+		{"foo.socket", dispatchSocketUnit, "foo.socket"},
+		{"foo.timer", dispatchTimerUnit, "foo.timer"},
+		{"foo.path", dispatchPathUnit, "foo.path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			d, unitname := unitDispatcherFor(tt.in)
+			if unitname != tt.wantUnitname {
+				t.Errorf("unitDispatcherFor(%q) unitname = %q, want %q", tt.in, unitname, tt.wantUnitname)
+			}
+			if funcName(d) != funcName(tt.wantDispatch) {
+				t.Errorf("unitDispatcherFor(%q) dispatcher = %s, want %s", tt.in, funcName(d), funcName(tt.wantDispatch))
+			}
+		})
+	}
+}
+
+func TestTriggeredUnitName(t *testing.T) {
+	tests := []struct {
+		unitname, suffix, want string
+	}{
+		{"foo.socket", ".socket", "foo.service"},
+		{"foo.timer", ".timer", "foo.service"},
+		{"foo.path", ".path", "foo.service"},
+	}
+	for _, tt := range tests {
+		if got := triggeredUnitName(tt.unitname, tt.suffix); got != tt.want {
+			t.Errorf("triggeredUnitName(%q, %q) = %q, want %q", tt.unitname, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestWatchedTriggeredUnit(t *testing.T) {
+	tests := []struct {
+		unitname string
+		want     string
+	}{
+		{"foo.service", ""},
+		{"foo.mount", ""},
+		{"foo.socket", "foo.service"},
+		{"foo.timer", "foo.service"},
+		{"foo.path", "foo.service"},
+	}
+	for _, tt := range tests {
+		if got := watchedTriggeredUnit(tt.unitname); got != tt.want {
+			t.Errorf("watchedTriggeredUnit(%q) = %q, want %q", tt.unitname, got, tt.want)
+		}
+	}
+}
+
+// TestRunRebootMaxReboots checks the KOLA_REBOOT_COUNT/--max-reboots guard
+// at the top of runReboot: once the env var reaches the configured max,
+// runReboot must refuse before touching systemd or the filesystem.  Below the
+// max, runReboot goes on past the guard (writing rebootStamp and starting the
+// sentinel unit), so that call only checks that its error is not a refusal.
+func TestRunRebootMaxReboots(t *testing.T) {
+	origMethod, origMax := rebootMethod, rebootMaxReboots
+	rebootMethod = string(RebootMethodCold)
+	rebootMaxReboots = 5
+	defer func() {
+		rebootMethod, rebootMaxReboots = origMethod, origMax
+		os.Unsetenv(koletRebootCountEnv)
+	}()
+
+	if err := os.Setenv(koletRebootCountEnv, "5"); err != nil {
+		t.Fatal(err)
+	}
+	err := runReboot(context.Background(), "test-mark")
+	if err == nil || !strings.Contains(err.Error(), "refusing reboot") {
+		t.Fatalf("runReboot with %s=5 and max-reboots=5: got err %v, want a refusal", koletRebootCountEnv, err)
+	}
+
+	if err := os.Setenv(koletRebootCountEnv, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runReboot(context.Background(), "test-mark"); err != nil && strings.Contains(err.Error(), "refusing reboot") {
+		t.Fatalf("runReboot with %s=1 and max-reboots=5 was refused unexpectedly: %v", koletRebootCountEnv, err)
+	}
+}